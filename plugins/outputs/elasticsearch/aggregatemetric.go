@@ -0,0 +1,100 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+)
+
+// aggregateMetricSuffixes maps the suffixes of the fields an aggregate metric
+// field is built from to the metrics of the field
+var aggregateMetricSuffixes = map[string]string{
+	"_min":   "min",
+	"_max":   "max",
+	"_sum":   "sum",
+	"_count": "value_count",
+}
+
+// aggregatePart is a field holding one metric of an aggregate metric field
+type aggregatePart struct {
+	key    string
+	value  interface{}
+	metric string
+	number interface{}
+}
+
+// aggregateMetricField checks if the field holds a metric of one of the
+// configured aggregate metric fields, i.e. is named "<name>_min", "<name>_max",
+// "<name>_sum" or "<name>_count", and returns the name and the metric.
+func (a *Elasticsearch) aggregateMetricField(field string) (string, string, bool) {
+	for _, name := range a.AggregateFields {
+		if !strings.HasPrefix(field, name+"_") {
+			continue
+		}
+		if metric, ok := aggregateMetricSuffixes[strings.TrimPrefix(field, name)]; ok {
+			return name, metric, true
+		}
+	}
+	return "", "", false
+}
+
+// aggregateMetricValue converts the field value to the value of the metric.
+// The value count must be a non-negative integer.
+func aggregateMetricValue(metric string, value interface{}) (interface{}, bool) {
+	var v float64
+	switch n := value.(type) {
+	case int64:
+		v = float64(n)
+	case uint64:
+		v = float64(n)
+	case float64:
+		v = n
+	default:
+		return nil, false
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, false
+	}
+	if metric != "value_count" {
+		return v, true
+	}
+	if v < 0 || v != math.Trunc(v) {
+		return nil, false
+	}
+	return int64(v), true
+}
+
+// buildAggregateMetric returns the value of an aggregate metric field if all
+// of its metrics are given, as Elasticsearch rejects incomplete values
+func buildAggregateMetric(parts []aggregatePart) (map[string]interface{}, bool) {
+	value := make(map[string]interface{}, len(parts))
+	for _, p := range parts {
+		value[p.metric] = p.number
+	}
+	return value, len(value) == len(aggregateMetricSuffixes)
+}
+
+// aggregateMetricDynamicTemplates returns the dynamic templates mapping the
+// configured aggregate metric fields by their name in the documents,
+// regardless of the document structure. The maximum is used by queries and
+// aggregations not asking for a specific metric.
+func aggregateMetricDynamicTemplates(names []string, prefix string) ([]string, error) {
+	templates := make([]string, 0, len(names))
+	for _, name := range names {
+		t, err := json.Marshal(map[string]interface{}{
+			"aggregate_metric_" + name: map[string]interface{}{
+				"match": prefix + name,
+				"mapping": map[string]interface{}{
+					"type":           "aggregate_metric_double",
+					"metrics":        []string{"min", "max", "sum", "value_count"},
+					"default_metric": "max",
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, string(t))
+	}
+	return templates, nil
+}
@@ -0,0 +1,74 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	awsV2 "github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// awsSigV4Transport signs every outgoing request with AWS Signature Version 4.
+// Signing happens in the transport so that each attempt, including retries
+// done by the client, gets a fresh signature computed over the final
+// (possibly gzip compressed) request body.
+type awsSigV4Transport struct {
+	transport   http.RoundTripper
+	credentials awsV2.CredentialsProvider
+	signer      *v4.Signer
+	service     string
+	region      string
+}
+
+func newAWSSigV4Transport(transport http.RoundTripper, cfg awsV2.Config, service string) *awsSigV4Transport {
+	return &awsSigV4Transport{
+		transport:   transport,
+		credentials: cfg.Credentials,
+		signer:      v4.NewSigner(),
+		service:     service,
+		region:      cfg.Region,
+	}
+}
+
+func (t *awsSigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	// The signature scheme requires a sha256 of the request body, so we need
+	// a local copy of the full body.
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Body.Close(); err != nil {
+			return nil, err
+		}
+	}
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(body))
+
+	// A RoundTripper must not modify the original request
+	signed := req.Clone(ctx)
+	if req.Body != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+		signed.ContentLength = int64(len(body))
+	}
+
+	// The credentials provider caches and transparently refreshes
+	// temporary credentials before they expire.
+	credentials, err := t.credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving AWS credentials failed: %v", err)
+	}
+
+	if err := t.signer.SignHTTP(ctx, credentials, signed, payloadHash, t.service, t.region, time.Now().UTC()); err != nil {
+		return nil, fmt.Errorf("signing request failed: %v", err)
+	}
+
+	return t.transport.RoundTrip(signed)
+}
@@ -0,0 +1,101 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// States of the circuit breaker
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops writing to a failing cluster. After threshold
+// consecutive failed bulk requests it opens and fails all writes immediately
+// until the cooldown has passed. Then it lets a single bulk request through to
+// probe the cluster, closing again on success and reopening on failure. All
+// other requests fail immediately while the probe is in flight.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	log       telegraf.Logger
+
+	sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+	probeAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, log telegraf.Logger) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, log: log}
+}
+
+// allow returns an error if writes are currently blocked by the open breaker
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return nil
+	case breakerOpen:
+		if remaining := b.cooldown - time.Since(b.openedAt); remaining > 0 {
+			return fmt.Errorf("circuit breaker open after %d consecutive failures, retrying in %s", b.failures, remaining.Round(time.Second))
+		}
+		b.state = breakerHalfOpen
+		b.log.Info("Circuit breaker half-open, probing Elasticsearch")
+	}
+
+	// A probe aborted without an answer, e.g. on shutdown, never resolves,
+	// so another one is let through after the cooldown
+	if b.probing && time.Since(b.probeAt) < b.cooldown {
+		return fmt.Errorf("circuit breaker half-open, waiting for the probe of Elasticsearch")
+	}
+	b.probing = true
+	b.probeAt = time.Now()
+	return nil
+}
+
+// success records a bulk request answered by the cluster
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state != breakerClosed {
+		b.log.Info("Circuit breaker closed, Elasticsearch is available again")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records a failed bulk request and opens the breaker if the probe
+// failed or the threshold is reached
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.log.Warnf("Circuit breaker opened after %d consecutive failures, pausing writes for %s", b.failures, b.cooldown)
+	}
+}
@@ -0,0 +1,605 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/olivere/elastic"
+)
+
+// maxLoggedFailures limits the number of per-document failures logged for
+// a single write to avoid flooding the log.
+const maxLoggedFailures = 5
+
+// minimalBulkFilterPath trims the bulk response with minimal_bulk_response to
+// the fields needed to handle failures. The index and ID of the documents are
+// kept for logging and the dead letter file.
+const minimalBulkFilterPath = "errors,items.*.status,items.*.error,items.*._index,items.*._id"
+
+// send writes the given requests with the bulk API. Requests rejected by the
+// server because it is overloaded are retried with exponential backoff, only
+// resending the rejected documents and not the whole batch. Documents and
+// requests rejected for reasons that will not go away on retry are dropped,
+// so only transient failures return an error and keep the metrics buffered.
+// The documents failing transiently are kept as pending for a last attempt on
+// shutdown. Waiting between retries stops once the context is done.
+func (a *Elasticsearch) send(ctx context.Context, requests []elastic.BulkableRequest) error {
+	var failed, dropped []*elastic.BulkResponseItem
+	var failedOpaqueIDs, droppedOpaqueIDs []string
+	var deadLetters []deadLetter
+	var requestErr error
+	total := len(requests)
+
+	// The documents collected by earlier attempts are handled after the
+	// loop, so a failing request only ends the retries
+	for attempt := 0; len(requests) > 0; attempt++ {
+		opaqueID := a.newOpaqueID()
+		res, header, err := a.bulk(ctx, requests, opaqueID)
+		if err != nil {
+			if isTooLarge(err) && len(requests) > 1 {
+				// The body exceeds the limit of the cluster, e.g. below
+				// max_bulk_bytes or for a spooled segment, so halve it until
+				// it is accepted
+				a.breaker.success()
+				half := len(requests) / 2
+				a.Log.Warnf("Bulk request%s of %d documents is too large, splitting it", opaqueIDInfo(opaqueID), len(requests))
+				if err := a.send(ctx, requests[:half]); err != nil {
+					requestErr = err
+				}
+				if err := a.send(ctx, requests[half:]); err != nil {
+					requestErr = err
+				}
+				break
+			}
+			if isFatal(err) {
+				// The cluster answered, but will never accept the request,
+				// e.g. because its body is malformed or too large
+				a.breaker.success()
+				a.Log.Errorf("Dropping %d of %d documents, bulk request%s rejected permanently: %s", len(requests), total, opaqueIDInfo(opaqueID), err)
+				break
+			}
+			if !isRetryable(err) || attempt >= a.MaxRetries {
+				a.breaker.failure()
+				a.addPending(requests...)
+				requestErr = fmt.Errorf("error sending bulk request to Elasticsearch%s: %s", opaqueIDInfo(opaqueID), err)
+				break
+			}
+			wait := a.retryWait(attempt, header)
+			a.Log.Warnf("Bulk request%s rejected: %s, retrying in %s", opaqueIDInfo(opaqueID), err, wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				a.addPending(requests...)
+				requestErr = fmt.Errorf("retrying bulk request to Elasticsearch%s aborted: %v", opaqueIDInfo(opaqueID), err)
+				break
+			}
+			continue
+		}
+
+		a.breaker.success()
+
+		if !res.Errors {
+			break
+		}
+
+		// Collect the documents rejected due to load for the next attempt,
+		// drop the ones that can never be written and fail the rest.
+		var retry []elastic.BulkableRequest
+		var retryItems []*elastic.BulkResponseItem
+		failures, drops := len(failed), len(dropped)
+		for i, item := range res.Items {
+			for op, r := range item {
+				switch {
+				case r.Error == nil:
+				case op == "create" && r.Status == http.StatusConflict:
+					// The document was already written by a previous attempt
+					a.Log.Debugf("Document %s already exists in index %s", r.Id, r.Index)
+				case a.VersionField != "" && r.Status == http.StatusConflict:
+					// A newer version of the document is already stored
+					a.Log.Debugf("Skipping stale version of document %s in index %s", r.Id, r.Index)
+				case isRetryableStatus(r.Status) && attempt < a.MaxRetries:
+					retry = append(retry, requests[i])
+					retryItems = append(retryItems, r)
+				case isIndexNotFoundError(r.Error) || isMissingPipelineError(r.Error):
+					// The alias, index or pipeline can be created on the cluster,
+					// so keep the document
+					failed = append(failed, r)
+					a.addPending(requests[i])
+				case a.DeadLetterFile != "" && isPermanentStatus(r.Status):
+					deadLetters = append(deadLetters, deadLetter{item: r, request: requests[i]})
+				case isPermanentStatus(r.Status):
+					dropped = append(dropped, r)
+				default:
+					failed = append(failed, r)
+					a.addPending(requests[i])
+				}
+			}
+		}
+		requests = retry
+		if len(failed) > failures && opaqueID != "" {
+			failedOpaqueIDs = append(failedOpaqueIDs, opaqueID)
+		}
+		if len(dropped) > drops && opaqueID != "" {
+			droppedOpaqueIDs = append(droppedOpaqueIDs, opaqueID)
+		}
+
+		if len(requests) > 0 {
+			wait := a.retryWait(attempt, nil)
+			a.Log.Warnf("Elasticsearch rejected %d documents, retrying in %s", len(requests), wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				a.Log.Warnf("Retrying rejected documents aborted: %v", err)
+				failed = append(failed, retryItems...)
+				a.addPending(requests...)
+				break
+			}
+		}
+	}
+
+	// Documents that cannot be written to the dead letter file are failures
+	if len(deadLetters) > 0 {
+		if err := a.writeDeadLetters(deadLetters); err != nil {
+			a.Log.Errorf("Writing to dead letter file %s failed: %v", a.DeadLetterFile, err)
+			for _, l := range deadLetters {
+				failed = append(failed, l.item)
+				a.addPending(l.request)
+			}
+		} else {
+			a.Log.Warnf("Elasticsearch rejected %d documents, written to dead letter file %s", len(deadLetters), a.DeadLetterFile)
+		}
+	}
+
+	if len(dropped) > 0 {
+		a.logFailures(dropped)
+		a.Log.Errorf("Dropped %d of %d documents rejected permanently by Elasticsearch%s", len(dropped), total, opaqueIDInfo(strings.Join(droppedOpaqueIDs, ", ")))
+	}
+
+	if len(failed) > 0 {
+		a.logFailures(failed)
+		if requestErr == nil {
+			requestErr = fmt.Errorf("elasticsearch failed to index %d of %d metrics%s", len(failed), total, opaqueIDInfo(strings.Join(failedOpaqueIDs, ", ")))
+		}
+	}
+
+	return requestErr
+}
+
+// flushPending makes a last attempt to write the documents that failed
+// transiently in the last write. On shutdown Telegraf drops the metrics kept
+// in its buffer, so this is the last chance to write them. The attempt,
+// including retries, is limited by shutdown_flush_timeout, so an unreachable
+// cluster does not block the shutdown.
+func (a *Elasticsearch) flushPending() {
+	if len(a.pending) == 0 {
+		return
+	}
+	pending := a.pending
+	a.pending = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.ShutdownFlushTimeout))
+	defer cancel()
+
+	a.Log.Infof("Flushing %d pending documents before closing", len(pending))
+	if err := a.send(ctx, pending); err != nil {
+		if a.SpoolDirectory != "" && a.spoolPending(err) == nil {
+			return
+		}
+		a.Log.Errorf("Flushing pending documents failed, dropped %d of %d documents: %v", len(a.pending), len(pending), err)
+	}
+	a.pending = nil
+}
+
+// encodedRequest is a bulk action with its serialized lines. Sharding,
+// splitting, retries and the spool all need the lines of a request, so the
+// document is serialized only once per write. Spooled requests are read back
+// in this form, too.
+type encodedRequest struct {
+	lines []string
+}
+
+func (r encodedRequest) String() string {
+	return strings.Join(r.lines, "\n")
+}
+
+func (r encodedRequest) Source() ([]string, error) {
+	return r.lines, nil
+}
+
+// encodeRequests serializes the requests not encoded yet
+func encodeRequests(requests []elastic.BulkableRequest) ([]elastic.BulkableRequest, error) {
+	encoded := make([]elastic.BulkableRequest, 0, len(requests))
+	for _, r := range requests {
+		if _, ok := r.(encodedRequest); ok {
+			encoded = append(encoded, r)
+			continue
+		}
+		lines, err := r.Source()
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, encodedRequest{lines: lines})
+	}
+	return encoded, nil
+}
+
+// splitBulk splits the requests into batches with a bulk body of at most
+// MaxBulkBytes. The uncompressed size is used as Elasticsearch checks the
+// decompressed body against its "http.max_content_length" limit. Documents
+// exceeding the limit on their own would be rejected on every attempt, so
+// they are logged and dropped.
+func (a *Elasticsearch) splitBulk(requests []elastic.BulkableRequest) ([][]elastic.BulkableRequest, error) {
+	if a.MaxBulkBytes <= 0 {
+		return [][]elastic.BulkableRequest{requests}, nil
+	}
+	limit := int64(a.MaxBulkBytes)
+
+	var batches [][]elastic.BulkableRequest
+	var batch []elastic.BulkableRequest
+	var size int64
+	for _, r := range requests {
+		lines, err := r.Source()
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for _, line := range lines {
+			n += int64(len(line)) + 1
+		}
+
+		if n > limit {
+			a.Log.Errorf("Dropping document of %d bytes exceeding max_bulk_bytes: %s", n, lines[0])
+			continue
+		}
+		if size+n > limit {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, r)
+		size += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+// logFailures logs the reasons for the first failed documents of a write
+func (a *Elasticsearch) logFailures(failed []*elastic.BulkResponseItem) {
+	for i, item := range failed {
+		if i >= maxLoggedFailures {
+			a.Log.Errorf("Elasticsearch indexing failure for %d more documents not shown", len(failed)-i)
+			break
+		}
+
+		err := item.Error
+		if isMissingPipelineError(err) {
+			a.Log.Errorf("Elasticsearch indexing failure, index: %s, ingest pipeline does not exist: %s", item.Index, err.Reason)
+			continue
+		}
+		if isRequireAliasError(err) {
+			a.Log.Errorf("Elasticsearch indexing failure, index: %s is not an alias but require_alias is set, create the alias or fix the index name: %s", item.Index, err.Reason)
+			continue
+		}
+		if isIndexNotFoundError(err) {
+			a.Log.Errorf("Elasticsearch indexing failure, index: %s does not exist, create it or fix the index name: %s", item.Index, err.Reason)
+			continue
+		}
+		a.Log.Errorf("Elasticsearch indexing failure, index: %s, id: %s, status: %d, error: %s, %s, caused by: %s, %s",
+			item.Index, item.Id, item.Status, err.Type, err.Reason, err.CausedBy["type"], err.CausedBy["reason"])
+	}
+}
+
+// bulk sends a single bulk request and decodes the response. The request is
+// sent to the nodes selected by the load balancing strategy, failing over to
+// the next node if a node is unreachable. The response header is returned
+// even on error to allow honoring "Retry-After".
+func (a *Elasticsearch) bulk(ctx context.Context, requests []elastic.BulkableRequest, opaqueID string) (*elastic.BulkResponse, http.Header, error) {
+	body := getBuffer()
+	defer putBuffer(body)
+	for _, r := range requests {
+		lines, err := r.Source()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, line := range lines {
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+	}
+
+	payload := body.Bytes()
+	if a.Compression != "none" {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if err := a.compress(buf, payload); err != nil {
+			return nil, nil, err
+		}
+		payload = buf.Bytes()
+	}
+
+	path := "/_bulk"
+	params := url.Values{}
+	if a.Refresh != "" && a.Refresh != "false" {
+		params.Set("refresh", a.Refresh)
+	}
+	if a.RequireAlias {
+		params.Set("require_alias", "true")
+	}
+	if a.WaitForActiveShards != "" {
+		params.Set("wait_for_active_shards", a.WaitForActiveShards)
+	}
+	if a.MinimalBulkResponse {
+		params.Set("filter_path", minimalBulkFilterPath)
+	}
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.WriteTimeout))
+	defer cancel()
+
+	var lastErr error
+	for _, n := range a.nodes.candidates() {
+		start := time.Now()
+		res, header, err := a.bulkToNode(ctx, n, path, payload, opaqueID)
+		elapsed := time.Since(start)
+		n.stats.record(len(requests), len(payload), elapsed, res, err)
+		if a.SlowRequestThreshold > 0 && elapsed > time.Duration(a.SlowRequestThreshold) {
+			a.Log.Warnf("Slow bulk request%s to %s took %s for %d documents of %d bytes", opaqueIDInfo(opaqueID), redactURL(n.url), elapsed.Round(time.Millisecond), len(requests), len(payload))
+		}
+		if err == nil {
+			a.nodes.markHealthy(n)
+			return res, header, nil
+		}
+		if elastic.IsContextErr(err) || ctx.Err() != nil {
+			return nil, nil, err
+		}
+
+		// The node answered, so there is no point in failing over
+		if e, ok := err.(*elastic.Error); ok {
+			if e.Status >= 500 {
+				a.nodes.markFailed(n, false)
+			} else {
+				a.nodes.markHealthy(n)
+			}
+			return nil, header, err
+		}
+
+		a.Log.Debugf("Sending bulk request%s to %s failed: %v", opaqueIDInfo(opaqueID), n.url, err)
+		a.nodes.markFailed(n, true)
+		lastErr = err
+	}
+
+	return nil, nil, lastErr
+}
+
+// compress writes the payload compressed with the configured compression to
+// the buffer
+func (a *Elasticsearch) compress(buf *bytes.Buffer, payload []byte) error {
+	if a.Compression == "zstd" {
+		enc, err := a.getZstdEncoder(buf)
+		if err != nil {
+			return err
+		}
+		defer a.zstdEncoders.Put(enc)
+
+		if _, err := enc.Write(payload); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	gz, err := a.getGzipWriter(buf)
+	if err != nil {
+		return err
+	}
+	defer a.gzipWriters.Put(gz)
+
+	if _, err := gz.Write(payload); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// bulkToNode sends the bulk request body to the given node
+func (a *Elasticsearch) bulkToNode(ctx context.Context, n *node, path string, payload []byte, opaqueID string) (*elastic.BulkResponse, http.Header, error) {
+	req, err := a.newRequest(ctx, http.MethodPost, n.url+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if a.Compression != "none" {
+		req.Header.Set("Content-Encoding", a.Compression)
+	}
+	if a.AcceptCompressed {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if opaqueID != "" {
+		req.Header.Set("X-Opaque-Id", opaqueID)
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var reader io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, resp.Header, fmt.Errorf("decompressing bulk response failed: %v", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, resp.Header, fmt.Errorf("reading bulk response failed: %v", err)
+	}
+	// Formatting every response is costly for large bulk requests, so it is
+	// only done if enabled
+	if a.MaxDebugResponse > 0 {
+		a.Log.Debugf("Bulk response of %s with status %d: %s", n.url, resp.StatusCode, truncateResponse(data, int(a.MaxDebugResponse)))
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// The error details are optional, so ignore decoding errors
+		e := &elastic.Error{}
+		_ = json.Unmarshal(data, e)
+		e.Status = resp.StatusCode
+		return nil, resp.Header, e
+	}
+
+	res := &elastic.BulkResponse{}
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, resp.Header, fmt.Errorf("decoding bulk response failed: %v", err)
+	}
+	return res, resp.Header, nil
+}
+
+// newOpaqueID returns a unique id sent as "X-Opaque-Id" header with a bulk
+// request, allowing to find it in the logs of the cluster, or an empty string
+// if no prefix is configured.
+func (a *Elasticsearch) newOpaqueID() string {
+	if a.OpaqueIDPrefix == "" {
+		return ""
+	}
+	u, err := uuid.NewV4()
+	if err != nil {
+		a.Log.Warnf("Generating opaque id failed, sending bulk request without it: %v", err)
+		return ""
+	}
+	return a.OpaqueIDPrefix + "-" + u.String()
+}
+
+// opaqueIDInfo formats the opaque ids for log and error messages
+func opaqueIDInfo(opaqueID string) string {
+	if opaqueID == "" {
+		return ""
+	}
+	return " (X-Opaque-Id " + opaqueID + ")"
+}
+
+// sleepContext waits for the given time, returning early with the error of
+// the context if it is done before
+func sleepContext(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryWait computes the time to wait before the given retry attempt,
+// preferring the server provided "Retry-After" header if present. Both are
+// limited to max_retry_interval, the exponential backoff is randomized
+// by up to half of the wait.
+func (a *Elasticsearch) retryWait(attempt int, header http.Header) time.Duration {
+	limit := time.Duration(a.MaxRetryInterval)
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return minDuration(time.Duration(seconds)*time.Second, limit)
+		}
+		if t, err := http.ParseTime(retryAfter); err == nil {
+			if wait := time.Until(t); wait > 0 {
+				return minDuration(wait, limit)
+			}
+			return 0
+		}
+	}
+
+	// Double the interval step by step to stop at the limit before the
+	// shift overflows
+	wait := time.Duration(a.RetryInterval)
+	for i := 0; i < attempt && wait < limit; i++ {
+		wait *= 2
+	}
+	wait = minDuration(wait, limit)
+	return wait - randomJitter(wait/2)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func isRetryable(err error) bool {
+	e, ok := err.(*elastic.Error)
+	return ok && isRetryableStatus(e.Status)
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// isPermanentStatus checks if a failed document will never be accepted on
+// retry, e.g. because of a mapping conflict.
+func isPermanentStatus(status int) bool {
+	return status >= http.StatusBadRequest && status < http.StatusInternalServerError && !isRetryableStatus(status)
+}
+
+// isFatal checks if a bulk request was rejected as a whole for a reason that
+// will not go away on retry. Authentication, authorization and missing
+// endpoint errors are not fatal, as they are fixed on the cluster or in the
+// configuration and the metrics should be kept until then.
+func isFatal(err error) bool {
+	e, ok := err.(*elastic.Error)
+	if !ok {
+		return false
+	}
+	switch e.Status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout:
+		return false
+	}
+	return isPermanentStatus(e.Status)
+}
+
+// isTooLarge checks if a bulk request was rejected because of the size of
+// its body
+func isTooLarge(err error) bool {
+	e, ok := err.(*elastic.Error)
+	return ok && e.Status == http.StatusRequestEntityTooLarge
+}
+
+// isMissingPipelineError checks if a bulk item failed because the requested
+// ingest pipeline does not exist on the server.
+func isMissingPipelineError(err *elastic.ErrorDetails) bool {
+	return err != nil && err.Type == "illegal_argument_exception" &&
+		strings.HasPrefix(err.Reason, "pipeline with id [") && strings.HasSuffix(err.Reason, "] does not exist")
+}
+
+// isRequireAliasError checks if a bulk item failed because its target is not
+// an alias while the request requires one.
+func isRequireAliasError(err *elastic.ErrorDetails) bool {
+	return err != nil && err.Type == "index_not_found_exception" && strings.Contains(err.Reason, "[require_alias]")
+}
+
+// isIndexNotFoundError checks if a bulk item failed because its target does
+// not exist and cannot be created, e.g. with auto_create_index disabled on the
+// cluster. This includes targets that are no alias with require_alias.
+func isIndexNotFoundError(err *elastic.ErrorDetails) bool {
+	return err != nil && err.Type == "index_not_found_exception"
+}
+
+// truncateResponse returns the response body for logging, cut off after the
+// given number of bytes
+func truncateResponse(data []byte, limit int) string {
+	if limit <= 0 || len(data) <= limit {
+		return string(data)
+	}
+	return fmt.Sprintf("%s... (truncated, %d of %d bytes)", data[:limit], limit, len(data))
+}
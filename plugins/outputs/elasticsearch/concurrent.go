@@ -0,0 +1,134 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/olivere/elastic"
+)
+
+// shardRequests distributes the requests of a write over n shards sent
+// concurrently. Requests for the same document always go to the same shard
+// in their original order, so e.g. upserts of a document are applied in
+// order. Requests without an ID are independent and spread evenly.
+func shardRequests(requests []elastic.BulkableRequest, n int) ([][]elastic.BulkableRequest, error) {
+	shards := make([][]elastic.BulkableRequest, n)
+	var next int
+	for _, r := range requests {
+		lines, err := r.Source()
+		if err != nil {
+			return nil, err
+		}
+
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal([]byte(lines[0]), &action); err != nil {
+			return nil, fmt.Errorf("decoding bulk action failed: %v", err)
+		}
+
+		shard := -1
+		for _, meta := range action {
+			if meta.ID != "" {
+				h := fnv.New32a()
+				_, _ = h.Write([]byte(meta.Index + "/" + meta.ID))
+				shard = int(h.Sum32() % uint32(n))
+			}
+		}
+		if shard < 0 {
+			shard = next % n
+			next++
+		}
+		shards[shard] = append(shards[shard], r)
+	}
+
+	// Drop the empty shards of small writes
+	nonEmpty := shards[:0]
+	for _, shard := range shards {
+		if len(shard) > 0 {
+			nonEmpty = append(nonEmpty, shard)
+		}
+	}
+	return nonEmpty, nil
+}
+
+// sendRequests sends the requests of a write or a spool segment, distributed
+// over max_concurrent_bulks shards
+func (a *Elasticsearch) sendRequests(ctx context.Context, requests []elastic.BulkableRequest) error {
+	requests, err := encodeRequests(requests)
+	if err != nil {
+		return err
+	}
+
+	shards := [][]elastic.BulkableRequest{requests}
+	if a.MaxConcurrentBulks > 1 {
+		if shards, err = shardRequests(requests, a.MaxConcurrentBulks); err != nil {
+			return err
+		}
+	}
+	return a.sendShards(ctx, shards)
+}
+
+// sendShards sends the shards concurrently, each split into batches of at
+// most max_bulk_bytes sent one after another. With round-robin load
+// balancing every bulk request starts at the next healthy node, so the
+// shards are spread over the cluster. All batches are sent even if one
+// fails, as the others might still succeed.
+func (a *Elasticsearch) sendShards(ctx context.Context, shards [][]elastic.BulkableRequest) error {
+	var mu sync.Mutex
+	var total, failed int
+	var lastErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed++
+		lastErr = err
+	}
+
+	split := make([][][]elastic.BulkableRequest, 0, len(shards))
+	for _, shard := range shards {
+		batches, err := a.splitBulk(shard)
+		if err != nil {
+			return err
+		}
+		split = append(split, batches)
+		total += len(batches)
+	}
+
+	var wg sync.WaitGroup
+	for _, batches := range split {
+		wg.Add(1)
+		go func(batches [][]elastic.BulkableRequest) {
+			defer wg.Done()
+			for _, batch := range batches {
+				// Fail fast without adding load while the cluster is failing
+				if err := a.breaker.allow(); err != nil {
+					fail(err)
+					a.addPending(batch...)
+					continue
+				}
+				if err := a.send(ctx, batch); err != nil {
+					fail(err)
+				}
+			}
+		}(batches)
+	}
+	wg.Wait()
+
+	if failed > 1 {
+		return fmt.Errorf("%d of %d bulk requests failed, last error: %v", failed, total, lastErr)
+	}
+	return lastErr
+}
+
+// addPending keeps the requests for a last attempt on shutdown, safe to be
+// called by concurrent bulk requests
+func (a *Elasticsearch) addPending(requests ...elastic.BulkableRequest) {
+	a.pendingMu.Lock()
+	defer a.pendingMu.Unlock()
+	a.pending = append(a.pending, requests...)
+}
@@ -0,0 +1,71 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// deadLetter is a document permanently rejected by Elasticsearch
+type deadLetter struct {
+	item    *elastic.BulkResponseItem
+	request elastic.BulkableRequest
+}
+
+// deadLetterEntry is a single line of the dead letter file
+type deadLetterEntry struct {
+	Time     time.Time             `json:"time"`
+	Index    string                `json:"index"`
+	ID       string                `json:"id,omitempty"`
+	Status   int                   `json:"status"`
+	Error    *elastic.ErrorDetails `json:"error,omitempty"`
+	Document json.RawMessage       `json:"document"`
+}
+
+// writeDeadLetters appends the rejected documents with their errors to the
+// dead letter file as JSON lines. The file is opened for every write, so it
+// can be moved away by external tools for rotation. Writes of concurrent bulk
+// requests are serialized to not interleave their lines.
+func (a *Elasticsearch) writeDeadLetters(letters []deadLetter) error {
+	var buf []byte
+	now := time.Now()
+	for _, l := range letters {
+		lines, err := l.request.Source()
+		if err != nil {
+			return err
+		}
+		var document json.RawMessage
+		if len(lines) > 1 {
+			document = json.RawMessage(lines[1])
+		}
+
+		entry, err := json.Marshal(deadLetterEntry{
+			Time:     now,
+			Index:    l.item.Index,
+			ID:       l.item.Id,
+			Status:   l.item.Status,
+			Error:    l.item.Error,
+			Document: document,
+		})
+		if err != nil {
+			return err
+		}
+		buf = append(buf, entry...)
+		buf = append(buf, '\n')
+	}
+
+	a.deadLetterMu.Lock()
+	defer a.deadLetterMu.Unlock()
+
+	f, err := os.OpenFile(a.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
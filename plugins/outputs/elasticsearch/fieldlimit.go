@@ -0,0 +1,40 @@
+package elasticsearch
+
+import (
+	"strings"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// newFieldLimitStat registers the number of metrics exceeding
+// max_fields_per_document, reported as the "field_limit_exceeded" field of
+// the "internal_elasticsearch" measurement tagged with the configured urls
+func newFieldLimitStat(urls []string) selfstat.Stat {
+	tags := map[string]string{"urls": strings.Join(urls, ",")}
+	return selfstat.Register("elasticsearch", "field_limit_exceeded", tags)
+}
+
+// limitFields protects the mapping of the cluster against metrics with too
+// many fields. Metrics exceeding max_fields_per_document are dropped, or
+// truncated to their first fields with max_fields_action "truncate". The
+// returned flag is false if the metric is dropped.
+func (a *Elasticsearch) limitFields(metric telegraf.Metric) (telegraf.Metric, bool) {
+	fields := metric.FieldList()
+	if a.MaxFieldsPerDocument <= 0 || len(fields) <= a.MaxFieldsPerDocument {
+		return metric, true
+	}
+	a.fieldLimitHits.Incr(1)
+
+	if a.MaxFieldsAction != "truncate" {
+		a.Log.Warnf("Dropping metric %q with %d fields exceeding max_fields_per_document of %d", metric.Name(), len(fields), a.MaxFieldsPerDocument)
+		return nil, false
+	}
+
+	a.Log.Warnf("Truncating metric %q with %d fields to max_fields_per_document of %d", metric.Name(), len(fields), a.MaxFieldsPerDocument)
+	metric = metric.Copy()
+	for _, field := range fields[a.MaxFieldsPerDocument:] {
+		metric.RemoveField(field.Key)
+	}
+	return metric, true
+}
@@ -0,0 +1,105 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// histogramBucket is a single bucket of a histogram field
+type histogramBucket struct {
+	bound float64
+	count float64
+}
+
+// histogram is the value of an Elasticsearch "histogram" field
+type histogram struct {
+	Values []float64 `json:"values"`
+	Counts []int64   `json:"counts"`
+}
+
+// histogramBucketField checks if the field is a bucket of one of the
+// configured histogram fields, i.e. named "<histogram>_<upper bound>", and
+// returns the histogram name and the upper bound of the bucket.
+func (a *Elasticsearch) histogramBucketField(field string) (string, float64, bool) {
+	for _, name := range a.HistogramFields {
+		if !strings.HasPrefix(field, name+"_") {
+			continue
+		}
+		bound, err := strconv.ParseFloat(strings.TrimPrefix(field, name+"_"), 64)
+		if err != nil || math.IsNaN(bound) {
+			continue
+		}
+		return name, bound, true
+	}
+	return "", 0, false
+}
+
+// histogramCount converts the value of a bucket field to a count
+func histogramCount(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, !math.IsNaN(v) && !math.IsInf(v, 0)
+	}
+	return 0, false
+}
+
+// buildHistogram converts the buckets with cumulative counts, as produced by
+// Prometheus and the Telegraf histogram aggregator, into the values and
+// per-bucket counts of an Elasticsearch histogram. The upper bounds are used
+// as values, the count of the "+Inf" bucket is added to the largest non-empty
+// finite bucket. Empty buckets are omitted.
+func buildHistogram(buckets []histogramBucket) (*histogram, error) {
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+
+	h := &histogram{Values: []float64{}, Counts: []int64{}}
+	var previous float64
+	for _, b := range buckets {
+		count := b.count - previous
+		if count < 0 {
+			return nil, fmt.Errorf("count of bucket %v is lower than of the previous one", b.bound)
+		}
+		previous = b.count
+		if count == 0 {
+			continue
+		}
+
+		if math.IsInf(b.bound, 1) {
+			if len(h.Counts) == 0 {
+				return nil, fmt.Errorf("no finite bucket for %v values above it", count)
+			}
+			h.Counts[len(h.Counts)-1] += int64(count)
+			continue
+		}
+		h.Values = append(h.Values, b.bound)
+		h.Counts = append(h.Counts, int64(count))
+	}
+	return h, nil
+}
+
+// histogramDynamicTemplates returns the dynamic templates mapping the
+// configured histogram fields by their name in the documents, regardless of
+// the document structure.
+func histogramDynamicTemplates(names []string, prefix string) ([]string, error) {
+	templates := make([]string, 0, len(names))
+	for _, name := range names {
+		t, err := json.Marshal(map[string]interface{}{
+			"histogram_" + name: map[string]interface{}{
+				"match":   prefix + name,
+				"mapping": map[string]string{"type": "histogram"},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, string(t))
+	}
+	return templates, nil
+}
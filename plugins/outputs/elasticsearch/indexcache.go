@@ -0,0 +1,92 @@
+package elasticsearch
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxIndexNameBuckets is the number of time buckets kept in the index
+	// name cache, the current one plus some for late metrics
+	maxIndexNameBuckets = 4
+	// maxIndexNamesPerBucket limits the cached names of a single time bucket,
+	// e.g. for high-cardinality tags in the index name
+	maxIndexNamesPerBucket = 10000
+)
+
+// indexNameCache caches the resolved index names by index name format, time
+// bucket and tag values, as resolving the date specifiers is expensive and
+// their values only change at the boundary of a day, or an hour if "%H" is
+// used. The oldest time bucket is evicted when a new one is added.
+type indexNameCache struct {
+	sync.Mutex
+	buckets map[int64]map[string]string
+}
+
+func newIndexNameCache() *indexNameCache {
+	return &indexNameCache{buckets: make(map[int64]map[string]string)}
+}
+
+// timeBucket returns the time bucket of the given time in the given location,
+// the hour or the day depending on the date specifiers of the index name
+func timeBucket(indexName string, t time.Time, location *time.Location) int64 {
+	if !strings.Contains(indexName, "%") {
+		return 0
+	}
+	t = t.In(location)
+	year, month, day := t.Date()
+	bucket := int64(year)*10000 + int64(month)*100 + int64(day)
+	if strings.Contains(indexName, "%H") {
+		bucket = bucket*100 + int64(t.Hour())
+	}
+	return bucket
+}
+
+// indexNameKey builds the cache key from the index name format and the tag
+// values it is resolved with
+func indexNameKey(indexName string, tagValues []interface{}) string {
+	var key strings.Builder
+	key.WriteString(indexName)
+	for _, v := range tagValues {
+		key.WriteByte(0)
+		key.WriteString(v.(string))
+	}
+	return key.String()
+}
+
+func (c *indexNameCache) get(bucket int64, key string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	name, ok := c.buckets[bucket][key]
+	return name, ok
+}
+
+func (c *indexNameCache) add(bucket int64, key, name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	names, ok := c.buckets[bucket]
+	if !ok {
+		if len(c.buckets) >= maxIndexNameBuckets {
+			oldest := bucket
+			for b := range c.buckets {
+				if b < oldest {
+					oldest = b
+				}
+			}
+			// Metrics older than all cached buckets are not cached
+			if oldest == bucket {
+				return
+			}
+			delete(c.buckets, oldest)
+		}
+		names = make(map[string]string)
+		c.buckets[bucket] = names
+	}
+	if len(names) >= maxIndexNamesPerBucket {
+		return
+	}
+	names[key] = name
+}
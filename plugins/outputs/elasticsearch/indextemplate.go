@@ -0,0 +1,49 @@
+package elasticsearch
+
+import (
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// indexTemplateData is the data the index_template is executed with
+type indexTemplateData struct {
+	Name   string
+	Tags   map[string]string
+	Fields map[string]interface{}
+	Time   time.Time
+}
+
+// parseIndexTemplate parses the index_template. Missing tags resolve to an
+// empty string, so they can be checked in conditions and replaced with "or".
+func parseIndexTemplate(text string) (*template.Template, error) {
+	return template.New("index_template").Option("missingkey=zero").Parse(text)
+}
+
+// executeIndexTemplate resolves the index name of the metric from the index
+// template, with the metric time in the configured timezone. Surrounding
+// whitespace, e.g. from line breaks between actions, is removed. An empty
+// name is returned if the template fails, so the metric is handled like any
+// other metric with an invalid index name.
+func (a *Elasticsearch) executeIndexTemplate(metric telegraf.Metric) string {
+	data := indexTemplateData{
+		Name:   metric.Name(),
+		Tags:   metric.Tags(),
+		Fields: metric.Fields(),
+		Time:   metric.Time().In(a.locationOrUTC()),
+	}
+
+	var b strings.Builder
+	if err := a.indexTemplate.Execute(&b, data); err != nil {
+		a.Log.Debugf("Executing index_template for metric %q failed: %v", metric.Name(), err)
+		return ""
+	}
+
+	name := strings.TrimSpace(b.String())
+	if a.ForceLowercaseIndex {
+		name = strings.ToLower(name)
+	}
+	return name
+}
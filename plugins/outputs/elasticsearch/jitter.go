@@ -0,0 +1,21 @@
+package elasticsearch
+
+import (
+	"math/rand"
+	"time"
+)
+
+// randomJitter returns a random duration in [0, max), spreading requests of
+// many Telegraf instances started or configured at the same time
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// healthCheckDelay returns the time until the next health check, i.e. the
+// health_check_interval extended by a random health_check_jitter
+func (a *Elasticsearch) healthCheckDelay() time.Duration {
+	return time.Duration(a.HealthCheckInterval) + randomJitter(time.Duration(a.HealthCheckJitter))
+}
@@ -0,0 +1,116 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// maxExistingIndexes limits the number of index names known to exist, e.g.
+// for high-cardinality tags in the index name. The cache is cleared when full.
+const maxExistingIndexes = 10000
+
+// missingIndexes returns the given write targets that do not exist. An
+// existing target is remembered, so every index is only checked once. Missing
+// targets are checked again by the next write, as they might have been
+// created in the meantime.
+func (a *Elasticsearch) missingIndexes(ctx context.Context, names map[string]bool) ([]string, error) {
+	var missing []string
+	for name := range names {
+		if a.existingIndexes[name] {
+			continue
+		}
+		exists, err := a.indexExists(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("checking existence of index %s failed: %v", name, err)
+		}
+		if !exists {
+			missing = append(missing, name)
+			continue
+		}
+		if a.existingIndexes == nil || len(a.existingIndexes) >= maxExistingIndexes {
+			a.existingIndexes = make(map[string]bool)
+		}
+		a.existingIndexes[name] = true
+	}
+
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// checkIndexesExist fails if one of the given write targets does not exist
+func (a *Elasticsearch) checkIndexesExist(ctx context.Context, names map[string]bool) error {
+	missing, err := a.missingIndexes(ctx, names)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("indexes do not exist and disable_auto_create_index is set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// dropMissingTargets removes the requests whose target, given at the same
+// position, does not exist. Their documents are rejected until the index is
+// created, so they must not keep the rest of the batch in the Telegraf buffer.
+func (a *Elasticsearch) dropMissingTargets(ctx context.Context, requests []elastic.BulkableRequest, targets []string) ([]elastic.BulkableRequest, error) {
+	names := make(map[string]bool)
+	for _, target := range targets {
+		names[target] = true
+	}
+	missing, err := a.missingIndexes(ctx, names)
+	if err != nil || len(missing) == 0 {
+		return requests, err
+	}
+
+	isMissing := make(map[string]bool, len(missing))
+	for _, name := range missing {
+		isMissing[name] = true
+	}
+	kept := make([]elastic.BulkableRequest, 0, len(requests))
+	for i, r := range requests {
+		if !isMissing[targets[i]] {
+			kept = append(kept, r)
+		}
+	}
+	a.Log.Errorf("Dropped %d of %d documents, indexes do not exist and disable_auto_create_index is set: %s",
+		len(requests)-len(kept), len(requests), strings.Join(missing, ", "))
+	return kept, nil
+}
+
+// indexExists checks if an index, alias or data stream of the given name
+// exists
+func (a *Elasticsearch) indexExists(ctx context.Context, name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Timeout))
+	defer cancel()
+
+	res, err := a.Client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       http.MethodHead,
+		Path:         "/" + url.PathEscape(name),
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.StatusCode == http.StatusOK, nil
+}
+
+// staticWriteTarget returns the index or alias all metrics are written to if
+// it does not depend on the metrics, so it can be checked on connect
+func (a *Elasticsearch) staticWriteTarget() (string, bool) {
+	switch {
+	case len(a.Routes) > 0 || a.IndexTagOverride != "" || a.indexTemplate != nil:
+		return "", false
+	case a.IndexAlias != "":
+		return a.IndexAlias, true
+	case len(a.TagKeys) > 0 || strings.Contains(a.IndexName, "%") || a.RolloverInterval > 0:
+		return "", false
+	}
+	return a.IndexName, true
+}
@@ -0,0 +1,75 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// moduloSeparator separates the field of an index name placeholder from the
+// number of buckets its value is distributed over, e.g.
+// "{{field:tenant_id|mod:16}}"
+const moduloSeparator = "|mod:"
+
+// splitModulo splits the field key of an index name placeholder into the
+// field name and the number of buckets, which is 0 without a modulo
+func splitModulo(key string) (string, int64, error) {
+	i := strings.Index(key, moduloSeparator)
+	if i < 0 {
+		return key, 0, nil
+	}
+	field, value := strings.TrimSpace(key[:i]), strings.TrimSpace(key[i+len(moduloSeparator):])
+	buckets, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || buckets <= 0 {
+		return field, 0, fmt.Errorf("invalid modulo %q of field %q, expected a positive integer", value, field)
+	}
+	return field, buckets, nil
+}
+
+// checkModulo validates the modulo of the field placeholders of an index name
+func checkModulo(keys []string) error {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, fieldKeyPrefix) {
+			continue
+		}
+		if _, _, err := splitModulo(strings.TrimPrefix(key, fieldKeyPrefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moduloBucket returns the bucket of an integer field value, zero-padded to
+// the width of the largest bucket so the index names sort in order. Floats
+// are accepted if they hold an integer and strings if they can be parsed as
+// one, other values have no bucket.
+func moduloBucket(value interface{}, buckets int64) (string, bool) {
+	var bucket int64
+	switch v := value.(type) {
+	case int64:
+		bucket = v % buckets
+	case uint64:
+		bucket = int64(v % uint64(buckets))
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return "", false
+		}
+		bucket = int64(v) % buckets
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return "", false
+		}
+		bucket = n % buckets
+	default:
+		return "", false
+	}
+	// Keep the bucket of negative values within the range of buckets as well
+	if bucket < 0 {
+		bucket += buckets
+	}
+
+	width := len(strconv.FormatInt(buckets-1, 10))
+	return fmt.Sprintf("%0*d", width, bucket), true
+}
@@ -0,0 +1,350 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// maxNodeFailures is the number of consecutive server errors after which a
+// node is taken out of rotation until it passes a health check again.
+const maxNodeFailures = 3
+
+// node is a single Elasticsearch endpoint bulk requests are sent to
+type node struct {
+	url      string
+	healthy  bool
+	failures int
+	// sniffed nodes were discovered from the cluster instead of configured
+	sniffed bool
+	stats   *nodeStats
+}
+
+func newNode(url string, sniffed bool) *node {
+	return &node{url: url, healthy: true, sniffed: sniffed, stats: newNodeStats(url)}
+}
+
+// nodePool selects the nodes to send bulk requests to according to the load
+// balancing strategy, skipping nodes considered unhealthy.
+type nodePool struct {
+	strategy string
+	// Without health checks failed nodes would never return to rotation,
+	// so they are only taken out if health checks are enabled.
+	healthChecks bool
+	log          telegraf.Logger
+	// healthyNodes reports the number of nodes in rotation
+	healthyNodes selfstat.Stat
+
+	sync.Mutex
+	nodes []*node
+	next  int
+}
+
+func newNodePool(urls []string, strategy string, healthChecks bool, log telegraf.Logger) *nodePool {
+	nodes := make([]*node, 0, len(urls))
+	for _, u := range urls {
+		nodes = append(nodes, newNode(strings.TrimRight(u, "/"), false))
+	}
+
+	tags := map[string]string{"urls": strings.Join(urls, ",")}
+	p := &nodePool{
+		strategy:     strategy,
+		healthChecks: healthChecks,
+		log:          log,
+		healthyNodes: selfstat.Register("elasticsearch", "healthy_nodes", tags),
+		nodes:        nodes,
+	}
+	p.updateStats()
+	return p
+}
+
+// updateStats updates the number of healthy nodes, the caller must hold the lock
+func (p *nodePool) updateStats() {
+	var healthy int64
+	for _, n := range p.nodes {
+		if n.healthy {
+			healthy++
+		}
+	}
+	p.healthyNodes.Set(healthy)
+}
+
+// candidates returns the nodes in the order a request should try them. For
+// round-robin the starting node rotates with every call, for failover the
+// configured order is kept. Unhealthy nodes are only returned if there is no
+// healthy node left, to still give the request a chance to succeed.
+func (p *nodePool) candidates() []*node {
+	p.Lock()
+	defer p.Unlock()
+
+	ordered := p.nodes
+	if p.strategy == "round-robin" && len(p.nodes) > 1 {
+		start := p.next % len(p.nodes)
+		p.next = start + 1
+		ordered = append(append([]*node{}, p.nodes[start:]...), p.nodes[:start]...)
+	}
+
+	healthy := make([]*node, 0, len(ordered))
+	for _, n := range ordered {
+		if n.healthy {
+			healthy = append(healthy, n)
+		}
+	}
+	if len(healthy) == 0 {
+		return append([]*node{}, ordered...)
+	}
+	return healthy
+}
+
+// all returns all nodes, including the ones out of rotation
+func (p *nodePool) all() []*node {
+	p.Lock()
+	defer p.Unlock()
+
+	return append([]*node{}, p.nodes...)
+}
+
+// setSniffed replaces the discovered nodes with the given urls. Configured
+// nodes are always kept and nodes already known keep their health state.
+func (p *nodePool) setSniffed(urls []string) {
+	p.Lock()
+	defer p.Unlock()
+
+	known := make(map[string]*node, len(p.nodes))
+	nodes := make([]*node, 0, len(p.nodes)+len(urls))
+	for _, n := range p.nodes {
+		known[n.url] = n
+		if !n.sniffed {
+			nodes = append(nodes, n)
+		}
+	}
+	added := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		n, found := known[u]
+		if (found && !n.sniffed) || added[u] {
+			continue
+		}
+		if !found {
+			n = newNode(u, true)
+			p.log.Debugf("Discovered Elasticsearch node %s", u)
+		}
+		nodes = append(nodes, n)
+		added[u] = true
+	}
+	p.nodes = nodes
+	p.updateStats()
+}
+
+// markHealthy resets the failures of the node and puts it back into rotation
+func (p *nodePool) markHealthy(n *node) {
+	p.Lock()
+	defer p.Unlock()
+
+	n.failures = 0
+	if !n.healthy {
+		n.healthy = true
+		p.log.Infof("Elasticsearch node %s is available again", n.url)
+		p.updateStats()
+	}
+}
+
+// markFailed records a failed request to the node. The node is taken out of
+// rotation immediately if it is unreachable, or after repeated server errors.
+func (p *nodePool) markFailed(n *node, unreachable bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	n.failures++
+	if n.healthy && p.healthChecks && (unreachable || n.failures >= maxNodeFailures) {
+		n.healthy = false
+		p.log.Warnf("Elasticsearch node %s is unavailable, removing it from rotation", n.url)
+		p.updateStats()
+	}
+}
+
+// healthCheck periodically checks every node independently. Nodes failing the
+// check are taken out of rotation and put back once they respond again. It is
+// the only source of periodic requests besides the writes, so all of them are
+// spread by health_check_jitter.
+func (a *Elasticsearch) healthCheck(ctx context.Context) {
+	defer a.wg.Done()
+
+	timer := time.NewTimer(a.healthCheckDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if a.EnableSniffer {
+				if err := a.sniff(ctx); err != nil {
+					a.Log.Warnf("Sniffing Elasticsearch nodes failed: %v", err)
+				}
+			}
+			for _, n := range a.nodes.all() {
+				switch a.ping(ctx, n) {
+				case pingHealthy:
+					a.nodes.markHealthy(n)
+				case pingDegraded:
+					if a.AllowDegradedNodes {
+						a.Log.Debugf("Elasticsearch node %s is degraded, keeping it in rotation", n.url)
+						a.nodes.markHealthy(n)
+					} else {
+						a.nodes.markFailed(n, true)
+					}
+				default:
+					if ctx.Err() == nil {
+						a.nodes.markFailed(n, true)
+					}
+				}
+			}
+			timer.Reset(a.healthCheckDelay())
+		}
+	}
+}
+
+// Results of a health check of a node
+const (
+	pingFailed = iota
+	pingHealthy
+	// pingDegraded nodes are reachable but answer with 503, e.g. because the
+	// cluster has no elected master
+	pingDegraded
+)
+
+// ping checks if the node responds successfully. The root endpoint is used as
+// the cheapest request, not requiring any privileges on the cluster.
+func (a *Elasticsearch) ping(ctx context.Context, n *node) int {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.HealthCheckTimeout))
+	defer cancel()
+
+	// Serverless collections do not serve the root endpoint
+	path := "/"
+	if a.ServerlessMode {
+		path = "/_cat/indices"
+	}
+
+	req, err := a.newRequest(ctx, http.MethodHead, n.url+path, nil)
+	if err != nil {
+		return pingFailed
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return pingFailed
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return pingHealthy
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return pingDegraded
+	}
+	return pingFailed
+}
+
+// sniffRoles are the node roles bulk requests can be sent to
+var sniffRoles = []string{"data", "data_content", "data_hot", "data_warm", "data_cold", "data_frozen", "ingest"}
+
+// sniff queries the cluster for its nodes and puts the data and ingest nodes
+// into rotation. The scheme of the configured urls and the path_prefix are
+// used for the discovered nodes, as the cluster only reports addresses.
+func (a *Elasticsearch) sniff(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Timeout))
+	defer cancel()
+
+	var lastErr error
+	for _, n := range a.nodes.candidates() {
+		urls, err := a.sniffNode(ctx, n)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		a.nodes.setSniffed(urls)
+		return nil
+	}
+	return lastErr
+}
+
+func (a *Elasticsearch) sniffNode(ctx context.Context, n *node) ([]string, error) {
+	u, err := url.Parse(n.url)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := a.newRequest(ctx, http.MethodGet, n.url+"/_nodes/http", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("querying nodes from %s returned status %d", n.url, resp.StatusCode)
+	}
+
+	var info struct {
+		Nodes map[string]struct {
+			Roles []string `json:"roles"`
+			HTTP  struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decoding nodes from %s failed: %v", n.url, err)
+	}
+
+	var urls []string
+	for _, info := range info.Nodes {
+		if info.HTTP.PublishAddress == "" || !hasSniffRole(info.Roles) {
+			continue
+		}
+		urls = append(urls, u.Scheme+"://"+publishHost(info.HTTP.PublishAddress))
+	}
+	return prefixedURLs(urls, a.PathPrefix), nil
+}
+
+func hasSniffRole(roles []string) bool {
+	// Versions before 7.x do not report roles, so any node is eligible
+	if len(roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		for _, r := range sniffRoles {
+			if role == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publishHost returns the host and port of a publish address, which is either
+// "ip:port" or "hostname/ip:port" if the node has a hostname configured.
+func publishHost(address string) string {
+	parts := strings.SplitN(address, "/", 2)
+	if len(parts) == 1 {
+		return address
+	}
+	_, port, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return parts[1]
+	}
+	return net.JoinHostPort(parts[0], port)
+}
@@ -0,0 +1,86 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// oauth2Transport attaches a bearer token obtained with the OAuth2 client
+// credentials flow to every request. Tokens are cached and refreshed shortly
+// before they expire. If the server still rejects a token, e.g. because it
+// was revoked, a new token is fetched and the request is retried once.
+type oauth2Transport struct {
+	transport http.RoundTripper
+	config    clientcredentials.Config
+	ctx       context.Context
+
+	sync.Mutex
+	source oauth2.TokenSource
+}
+
+// newOAuth2Transport creates the transport authorizing requests sent through
+// transport. Tokens are fetched through tokenTransport, to use the same TLS
+// and proxy settings without e.g. signing the token requests.
+func newOAuth2Transport(transport, tokenTransport http.RoundTripper, config clientcredentials.Config) *oauth2Transport {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: tokenTransport})
+	return &oauth2Transport{
+		transport: transport,
+		config:    config,
+		ctx:       ctx,
+		source:    config.TokenSource(ctx),
+	}
+}
+
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.roundTrip(req, t.tokenSource())
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The body was consumed by the first attempt, so a retry is only
+	// possible if it can be recreated.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return t.roundTrip(retry, t.refresh())
+}
+
+func (t *oauth2Transport) roundTrip(req *http.Request, source oauth2.TokenSource) (*http.Response, error) {
+	token, err := source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// A RoundTripper must not modify the original request
+	authorized := req.Clone(req.Context())
+	token.SetAuthHeader(authorized)
+	return t.transport.RoundTrip(authorized)
+}
+
+func (t *oauth2Transport) tokenSource() oauth2.TokenSource {
+	t.Lock()
+	defer t.Unlock()
+	return t.source
+}
+
+// refresh discards the cached token so the next request fetches a new one
+func (t *oauth2Transport) refresh() oauth2.TokenSource {
+	t.Lock()
+	defer t.Unlock()
+	t.source = t.config.TokenSource(t.ctx)
+	return t.source
+}
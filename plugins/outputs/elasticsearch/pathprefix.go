@@ -0,0 +1,25 @@
+package elasticsearch
+
+import (
+	"strings"
+)
+
+// normalizePathPrefix returns the path_prefix with a leading and without a
+// trailing slash, or an empty string if no prefix is set
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// prefixedURLs appends the path_prefix to the paths of the URLs, so it is
+// prepended to the path of every request sent to them
+func prefixedURLs(urls []string, prefix string) []string {
+	prefixed := make([]string, 0, len(urls))
+	for _, u := range urls {
+		prefixed = append(prefixed, strings.TrimRight(u, "/")+prefix)
+	}
+	return prefixed
+}
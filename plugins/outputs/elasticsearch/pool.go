@@ -0,0 +1,56 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxPooledBufferSize limits the capacity of buffers returned to the pool, so
+// a single huge batch does not keep its memory allocated forever
+const maxPooledBufferSize = 32 * 1024 * 1024
+
+// bufferPool holds the buffers for the bulk request bodies, which are reused
+// for every write to reduce allocations under sustained load
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// getGzipWriter returns a pooled gzip writer with the configured compression
+// level writing to w. The writers are pooled per plugin instance, as the
+// compression level cannot be changed on reset.
+func (a *Elasticsearch) getGzipWriter(w io.Writer) (*gzip.Writer, error) {
+	if gz, ok := a.gzipWriters.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return gz, nil
+	}
+	return gzip.NewWriterLevel(w, a.GzipCompressionLevel)
+}
+
+// getZstdEncoder returns a pooled zstd encoder writing to w. Every encoder
+// compresses a single body at a time, so it is created without concurrency.
+func (a *Elasticsearch) getZstdEncoder(w io.Writer) (*zstd.Encoder, error) {
+	if enc, ok := a.zstdEncoders.Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return enc, nil
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
@@ -0,0 +1,92 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/influxdata/telegraf"
+	"github.com/olivere/elastic"
+)
+
+// getRawDocument returns the value of the raw document field if configured
+// and present in the metric.
+func (a *Elasticsearch) getRawDocument(metric telegraf.Metric) (interface{}, bool) {
+	if a.RawDocumentField == "" {
+		return nil, false
+	}
+	return metric.GetField(a.RawDocumentField)
+}
+
+// parseRawDocument decodes the value of the raw document field as the JSON
+// object used as document, adding the given timestamp as "@timestamp" if the
+// document does not contain it and the timestamp is not nil. Numbers are kept as json.Number, so large
+// integers are sent unchanged instead of being rounded to float64.
+func parseRawDocument(raw interface{}, timestamp interface{}) (map[string]interface{}, error) {
+	s, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a string but got %T", raw)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.New("expected a JSON object but got null")
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON object")
+	}
+
+	if _, ok := doc["@timestamp"]; !ok && timestamp != nil {
+		doc["@timestamp"] = timestamp
+	}
+	return doc, nil
+}
+
+// invalidRawDocument wraps a raw document that cannot be parsed as rejected
+// document, so it takes the same path as documents rejected by Elasticsearch.
+// The raw value is recorded as JSON string as it is no valid JSON document.
+func invalidRawDocument(index string, raw interface{}, err error) deadLetter {
+	// Strings are taken as serialized document by the bulk request, so the
+	// value is encoded first. Field values are scalars and always encode.
+	value, _ := json.Marshal(raw)
+	return deadLetter{
+		item: &elastic.BulkResponseItem{
+			Index:  index,
+			Status: http.StatusBadRequest,
+			Error: &elastic.ErrorDetails{
+				Type:   "invalid_raw_document",
+				Reason: err.Error(),
+			},
+		},
+		request: elastic.NewBulkIndexRequest().Index(index).Doc(json.RawMessage(value)),
+	}
+}
+
+// rejectRawDocuments writes the invalid raw documents to the dead letter file
+// if configured, otherwise they are logged and dropped as they would fail on
+// every retry.
+func (a *Elasticsearch) rejectRawDocuments(letters []deadLetter) error {
+	if a.DeadLetterFile == "" {
+		items := make([]*elastic.BulkResponseItem, 0, len(letters))
+		for _, l := range letters {
+			items = append(items, l.item)
+		}
+		a.logFailures(items)
+		a.Log.Errorf("Dropped %d documents with invalid %s field", len(letters), a.RawDocumentField)
+		return nil
+	}
+
+	if err := a.writeDeadLetters(letters); err != nil {
+		return fmt.Errorf("writing %d documents with invalid %s field to dead letter file %s failed: %v", len(letters), a.RawDocumentField, a.DeadLetterFile, err)
+	}
+	a.Log.Warnf("Found %d documents with invalid %s field, written to dead letter file %s", len(letters), a.RawDocumentField, a.DeadLetterFile)
+	return nil
+}
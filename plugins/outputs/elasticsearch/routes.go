@@ -0,0 +1,105 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
+)
+
+// Route sets the index, pipeline and op_type of the metrics it matches. A
+// metric matches if its name matches one of the measurement patterns and
+// every listed tag has a value matching one of its patterns. Conditions that
+// are not set match every metric. Settings that are not set keep the values
+// of the plugin.
+type Route struct {
+	Measurement []string            `toml:"measurement"`
+	Tags        map[string][]string `toml:"tags"`
+	Index       string              `toml:"index"`
+	Pipeline    string              `toml:"pipeline"`
+	OpType      string              `toml:"op_type"`
+
+	measurementFilter filter.Filter
+	tagFilters        map[string]filter.Filter
+	indexFormat       string
+	indexTagKeys      []string
+	pipelineFormat    string
+	pipelineTagKeys   []string
+}
+
+// compileRoutes checks the routes and prepares them for matching and
+// resolving their index and pipeline names
+func (a *Elasticsearch) compileRoutes() error {
+	for i := range a.Routes {
+		r := &a.Routes[i]
+
+		switch r.OpType {
+		case "":
+		case "index", "create":
+			if a.UseDataStream && r.OpType != "create" {
+				return fmt.Errorf("route %d: data streams require op_type \"create\"", i+1)
+			}
+		default:
+			return fmt.Errorf("route %d: invalid op_type %q", i+1, r.OpType)
+		}
+		if len(a.UpsertKeyTags) > 0 && (r.Pipeline != "" || r.OpType == "create") {
+			return fmt.Errorf("route %d: upsert_key_tags cannot be used together with pipeline or op_type \"create\"", i+1)
+		}
+		if r.Index != "" && a.UseDataStream {
+			for _, specifier := range dateSpecifiers {
+				if strings.Contains(r.Index, specifier) {
+					return fmt.Errorf("route %d: index %q contains date specifier %q which is not allowed for data streams", i+1, r.Index, specifier)
+				}
+			}
+		}
+
+		var err error
+		if r.measurementFilter, err = filter.Compile(r.Measurement); err != nil {
+			return fmt.Errorf("route %d: invalid measurement: %v", i+1, err)
+		}
+		r.tagFilters = make(map[string]filter.Filter, len(r.Tags))
+		for key, patterns := range r.Tags {
+			f, err := filter.Compile(patterns)
+			if err != nil {
+				return fmt.Errorf("route %d: invalid patterns of tag %q: %v", i+1, key, err)
+			}
+			if f == nil {
+				return fmt.Errorf("route %d: no patterns for tag %q", i+1, key)
+			}
+			r.tagFilters[key] = f
+		}
+
+		r.indexFormat, r.indexTagKeys = a.GetTagKeys(r.Index)
+		if err := checkModulo(r.indexTagKeys); err != nil {
+			return fmt.Errorf("route %d: %v", i+1, err)
+		}
+		r.pipelineFormat, r.pipelineTagKeys = a.GetTagKeys(r.Pipeline)
+	}
+	return nil
+}
+
+// getRoute returns the first route matching the metric, or nil if no route
+// matches and the settings of the plugin apply
+func (a *Elasticsearch) getRoute(metric telegraf.Metric) *Route {
+	for i := range a.Routes {
+		if a.Routes[i].matches(metric) {
+			return &a.Routes[i]
+		}
+	}
+	return nil
+}
+
+// matches checks if the metric satisfies all conditions of the route
+func (r *Route) matches(metric telegraf.Metric) bool {
+	if r.measurementFilter != nil && !r.measurementFilter.Match(metric.Name()) {
+		return false
+	}
+	for key, f := range r.tagFilters {
+		value, ok := metric.GetTag(key)
+		if !ok || !f.Match(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// defaultMaxSpoolBytes limits the size of the spool directory if
+// max_spool_bytes is not set
+const defaultMaxSpoolBytes = 100 * 1024 * 1024
+
+// defaultMaxSpoolReplay limits the size of the segments replayed at once if
+// max_spool_replay_bytes is not set
+const defaultMaxSpoolReplay = 10 * 1024 * 1024
+
+// spoolSuffix is the file extension of the spool segments
+const spoolSuffix = ".bulk"
+
+// spool persists the requests as a new segment of the spool directory, i.e.
+// a file holding the bulk body, so they survive a restart of Telegraf. The
+// oldest segments are dropped if the directory exceeds max_spool_bytes.
+func (a *Elasticsearch) spool(requests []elastic.BulkableRequest) error {
+	a.spoolSeq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), a.spoolSeq%1000000, spoolSuffix)
+	if err := writeSpoolSegment(filepath.Join(a.SpoolDirectory, name), requests); err != nil {
+		return err
+	}
+	a.trimSpool()
+	return nil
+}
+
+// writeSpoolSegment writes the bulk body of the requests to the segment. The
+// body is written to a temporary file first, so a crash never leaves a
+// partial segment behind.
+func writeSpoolSegment(name string, requests []elastic.BulkableRequest) error {
+	var buf bytes.Buffer
+	for _, r := range requests {
+		lines, err := r.Source()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0640); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// spoolPending moves the documents failing transiently in the write to the
+// spool, so the write succeeds and Telegraf does not send them again. The
+// error of the write is returned if they cannot be spooled, keeping the
+// metrics in the Telegraf buffer instead.
+func (a *Elasticsearch) spoolPending(writeErr error) error {
+	if len(a.pending) == 0 {
+		return writeErr
+	}
+	if err := a.spool(a.pending); err != nil {
+		a.Log.Errorf("Spooling %d documents to %s failed: %v", len(a.pending), a.SpoolDirectory, err)
+		return writeErr
+	}
+	a.Log.Warnf("Spooled %d documents to %s for later delivery: %v", len(a.pending), a.SpoolDirectory, writeErr)
+	a.pending = nil
+	return nil
+}
+
+// spoolSegments returns the segments of the spool directory, oldest first
+func (a *Elasticsearch) spoolSegments() ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(a.SpoolDirectory, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// trimSpool removes the oldest segments until the spool directory fits into
+// max_spool_bytes
+func (a *Elasticsearch) trimSpool() {
+	segments, err := a.spoolSegments()
+	if err != nil {
+		a.Log.Errorf("Listing spool directory %s failed: %v", a.SpoolDirectory, err)
+		return
+	}
+
+	sizes := make([]int64, len(segments))
+	var total int64
+	for i, segment := range segments {
+		if info, err := os.Stat(segment); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+
+	for i := 0; total > int64(a.MaxSpoolBytes) && i < len(segments); i++ {
+		if err := os.Remove(segments[i]); err != nil {
+			a.Log.Errorf("Removing spool segment %s failed: %v", segments[i], err)
+			continue
+		}
+		total -= sizes[i]
+		a.Log.Warnf("Spool directory %s exceeds max_spool_bytes, dropped oldest segment %s of %d bytes", a.SpoolDirectory, filepath.Base(segments[i]), sizes[i])
+	}
+}
+
+// replaySpool sends the spooled segments, oldest first, like the documents
+// of a write, i.e. split by max_bulk_bytes and guarded by the circuit breaker.
+// A segment is removed once written; documents rejected permanently are
+// dropped or written to the dead letter file as usual. If documents fail
+// again, the segment is replaced by the failed documents and replaying stops
+// until the next attempt, as the cluster is still failing. Every call replays
+// at most max_spool_replay_bytes, so a large backlog does not block the
+// writes for long.
+func (a *Elasticsearch) replaySpool(ctx context.Context) {
+	segments, err := a.spoolSegments()
+	if err != nil {
+		a.Log.Errorf("Listing spool directory %s failed: %v", a.SpoolDirectory, err)
+		return
+	}
+
+	var replayed int64
+	for _, segment := range segments {
+		if replayed >= int64(a.MaxSpoolReplay) {
+			a.Log.Debugf("Replayed %d spooled bytes, continuing with %s on the next write", replayed, filepath.Base(segment))
+			return
+		}
+		if info, err := os.Stat(segment); err == nil {
+			replayed += info.Size()
+		}
+
+		requests, err := readSpoolSegment(segment)
+		if err != nil {
+			// Keep the segment for inspection, but never replay it again
+			a.Log.Errorf("Reading spool segment %s failed, skipping it: %v", segment, err)
+			if err := os.Rename(segment, segment+".invalid"); err != nil {
+				a.Log.Errorf("Renaming invalid spool segment %s failed: %v", segment, err)
+			}
+			continue
+		}
+
+		a.pending = nil
+		err = a.sendRequests(ctx, requests)
+		failed := a.pending
+		a.pending = nil
+		if err == nil {
+			a.Log.Infof("Replayed %d spooled documents from %s", len(requests), filepath.Base(segment))
+			if err := os.Remove(segment); err != nil {
+				a.Log.Errorf("Removing spool segment %s failed: %v", segment, err)
+			}
+			continue
+		}
+
+		a.Log.Warnf("Replaying spool segment %s failed, %d of %d documents remain spooled: %v", filepath.Base(segment), len(failed), len(requests), err)
+		switch {
+		case len(failed) == 0:
+			if err := os.Remove(segment); err != nil {
+				a.Log.Errorf("Removing spool segment %s failed: %v", segment, err)
+			}
+		case len(failed) < len(requests):
+			// Keep the position of the segment to replay in order
+			if err := writeSpoolSegment(segment, failed); err != nil {
+				a.Log.Errorf("Rewriting spool segment %s failed: %v", segment, err)
+			}
+		}
+		return
+	}
+}
+
+// readSpoolSegment reads the bulk actions of a spool segment. Every action
+// consists of the action line followed by the document line.
+func readSpoolSegment(name string) ([]elastic.BulkableRequest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines)%2 != 0 {
+		return nil, fmt.Errorf("odd number of %d lines", len(lines))
+	}
+
+	requests := make([]elastic.BulkableRequest, 0, len(lines)/2)
+	for i := 0; i < len(lines); i += 2 {
+		requests = append(requests, encodedRequest{lines: lines[i : i+2]})
+	}
+	return requests, nil
+}
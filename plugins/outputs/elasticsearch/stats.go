@@ -0,0 +1,75 @@
+package elasticsearch
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/olivere/elastic"
+
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// nodeStats are the internal statistics of the bulk requests sent to a node,
+// reported as the "internal_elasticsearch" measurement tagged with the url.
+type nodeStats struct {
+	bulkRequests      selfstat.Stat
+	bulkErrors        selfstat.Stat
+	documentsSent     selfstat.Stat
+	documentsRejected selfstat.Stat
+	bytesSent         selfstat.Stat
+	writeTime         selfstat.Stat
+}
+
+// newNodeStats registers the statistics of the node. Stats registered before
+// for the same url, e.g. on reconnect, are reused.
+func newNodeStats(nodeURL string) *nodeStats {
+	tags := map[string]string{"url": redactURL(nodeURL)}
+	return &nodeStats{
+		bulkRequests:      selfstat.Register("elasticsearch", "bulk_requests", tags),
+		bulkErrors:        selfstat.Register("elasticsearch", "bulk_errors", tags),
+		documentsSent:     selfstat.Register("elasticsearch", "documents_sent", tags),
+		documentsRejected: selfstat.Register("elasticsearch", "documents_rejected", tags),
+		bytesSent:         selfstat.Register("elasticsearch", "bytes_sent", tags),
+		writeTime:         selfstat.RegisterTiming("elasticsearch", "write_time_ns", tags),
+	}
+}
+
+// record accounts a single bulk request of the given number of documents and
+// payload size. Requests failing without a response from the node did not
+// transfer the payload, so only the failure and the time are recorded.
+func (s *nodeStats) record(documents, size int, elapsed time.Duration, res *elastic.BulkResponse, err error) {
+	s.bulkRequests.Incr(1)
+	s.writeTime.Incr(elapsed.Nanoseconds())
+
+	if err != nil {
+		s.bulkErrors.Incr(1)
+		if _, ok := err.(*elastic.Error); !ok {
+			return
+		}
+	}
+	s.bytesSent.Incr(int64(size))
+	if res == nil {
+		return
+	}
+
+	var rejected int64
+	for _, item := range res.Items {
+		for _, r := range item {
+			if r.Error != nil {
+				rejected++
+			}
+		}
+	}
+	s.documentsSent.Incr(int64(documents))
+	s.documentsRejected.Incr(rejected)
+}
+
+// redactURL removes the credentials from the url to not expose them in tags
+func redactURL(nodeURL string) string {
+	u, err := url.Parse(nodeURL)
+	if err != nil || u.User == nil {
+		return nodeURL
+	}
+	u.User = nil
+	return u.String()
+}
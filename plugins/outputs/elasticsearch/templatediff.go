@@ -0,0 +1,224 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+// templateUpToDate checks if the installed index template, and for
+// composable templates the component template if given, match the given
+// bodies. The comparison is done on the decoded JSON, so formatting and key
+// order do not matter, and settings are compared in the flat string form the
+// cluster returns them in. Keys the cluster adds with default values, e.g.
+// "order" or "aliases", are ignored unless they are part of the given body.
+func (a *Elasticsearch) templateUpToDate(ctx context.Context, body, component string) (bool, error) {
+	installed, err := a.getInstalledTemplate(ctx, a.templatePath(), a.TemplateName)
+	if err != nil || installed == nil {
+		return false, err
+	}
+	if equal, err := templateEqual(body, installed); err != nil || !equal {
+		return false, err
+	}
+
+	if component == "" {
+		return true, nil
+	}
+	installed, err = a.getInstalledTemplate(ctx, "/_component_template/", a.componentTemplateName())
+	if err != nil || installed == nil {
+		return false, err
+	}
+	return templateEqual(component, installed)
+}
+
+// templatePath returns the API path of the index templates of the configured
+// template type
+func (a *Elasticsearch) templatePath() string {
+	if a.TemplateType == "composable" {
+		return "/_index_template/"
+	}
+	return "/_template/"
+}
+
+// getInstalledTemplate returns the body of the named template from the given
+// template API, or nil if the template does not exist. The APIs wrap the
+// template body differently in their responses.
+func (a *Elasticsearch) getInstalledTemplate(ctx context.Context, path, name string) (map[string]interface{}, error) {
+	res, err := a.Client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       http.MethodGet,
+		Path:         path + url.PathEscape(name),
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	switch path {
+	case "/_template/":
+		var templates map[string]map[string]interface{}
+		if err := json.Unmarshal(res.Body, &templates); err != nil {
+			return nil, err
+		}
+		return templates[name], nil
+	case "/_index_template/":
+		var templates struct {
+			IndexTemplates []struct {
+				Name          string                 `json:"name"`
+				IndexTemplate map[string]interface{} `json:"index_template"`
+			} `json:"index_templates"`
+		}
+		if err := json.Unmarshal(res.Body, &templates); err != nil {
+			return nil, err
+		}
+		for _, t := range templates.IndexTemplates {
+			if t.Name == name {
+				return t.IndexTemplate, nil
+			}
+		}
+	case "/_component_template/":
+		var templates struct {
+			ComponentTemplates []struct {
+				Name              string                 `json:"name"`
+				ComponentTemplate map[string]interface{} `json:"component_template"`
+			} `json:"component_templates"`
+		}
+		if err := json.Unmarshal(res.Body, &templates); err != nil {
+			return nil, err
+		}
+		for _, t := range templates.ComponentTemplates {
+			if t.Name == name {
+				return t.ComponentTemplate, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown template path %q", path)
+	}
+	return nil, nil
+}
+
+// templateEqual compares the template body with the installed template
+func templateEqual(body string, installed map[string]interface{}) (bool, error) {
+	var desired map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &desired); err != nil {
+		return false, err
+	}
+	return templateObjectEqual(desired, installed), nil
+}
+
+// templateObjectEqual checks if all keys of the desired template object match
+// the installed one. The "template" key holds the settings and mappings of
+// composable templates, and the index pattern of Elasticsearch 5 templates.
+func templateObjectEqual(desired, installed map[string]interface{}) bool {
+	for key, want := range desired {
+		have, found := installed[key]
+		switch key {
+		case "settings":
+			if !reflect.DeepEqual(normalizeSettings(want), normalizeSettings(have)) {
+				return false
+			}
+		case "mappings":
+			if !found || !reflect.DeepEqual(want, have) {
+				return false
+			}
+		case "template":
+			wantObject, ok1 := want.(map[string]interface{})
+			haveObject, ok2 := have.(map[string]interface{})
+			if !ok1 || !ok2 {
+				if !reflect.DeepEqual(want, have) {
+					return false
+				}
+				continue
+			}
+			if !templateObjectEqual(wantObject, haveObject) {
+				return false
+			}
+		default:
+			if !found || !containsJSON(have, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// containsJSON checks if the installed value contains the desired one, i.e.
+// objects may contain additional keys set to defaults by the cluster
+func containsJSON(have, want interface{}) bool {
+	wantObject, ok := want.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(have, want)
+	}
+	haveObject, ok := have.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for key, value := range wantObject {
+		if !containsJSON(haveObject[key], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeSettings converts index settings to the flat form with string
+// values and the "index." prefix, as the cluster accepts nested and dotted
+// keys, e.g. "lifecycle.name", with or without the prefix, but returns them
+// nested with all values as strings.
+func normalizeSettings(settings interface{}) map[string]string {
+	normalized := make(map[string]string)
+	for key, value := range flattenSettings("", settings) {
+		if !strings.HasPrefix(key, "index.") {
+			key = "index." + key
+		}
+		normalized[key] = value
+	}
+	return normalized
+}
+
+// flattenSettings joins the keys of nested settings objects with dots
+func flattenSettings(prefix string, settings interface{}) map[string]string {
+	flat := make(map[string]string)
+	object, ok := settings.(map[string]interface{})
+	if !ok {
+		return flat
+	}
+	for key, value := range object {
+		key = prefix + key
+		if nested, ok := value.(map[string]interface{}); ok {
+			for k, v := range flattenSettings(key+".", nested) {
+				flat[k] = v
+			}
+			continue
+		}
+		flat[key] = settingString(value)
+	}
+	return flat
+}
+
+// settingString returns the string form of a setting value
+func settingString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, settingString(e))
+		}
+		return strings.Join(values, ",")
+	default:
+		var buf bytes.Buffer
+		_ = json.NewEncoder(&buf).Encode(v)
+		return strings.TrimSpace(buf.String())
+	}
+}
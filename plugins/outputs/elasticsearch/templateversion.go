@@ -0,0 +1,92 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// templateVersionKey is the key of the version in the "_meta" object of the
+// templates, compared with template_version
+const templateVersionKey = "telegraf_template_version"
+
+// installedTemplateVersion returns the version of the installed template, or
+// 0 if it has no version. The version of composable templates is taken from
+// the component template if the index template has none.
+func (a *Elasticsearch) installedTemplateVersion(ctx context.Context) (int, error) {
+	installed, err := a.getInstalledTemplate(ctx, a.templatePath(), a.TemplateName)
+	if err != nil {
+		return 0, err
+	}
+	if version, found := templateMetaVersion(installed); found {
+		return version, nil
+	}
+	if a.TemplateType != "composable" {
+		return 0, nil
+	}
+
+	installed, err = a.getInstalledTemplate(ctx, "/_component_template/", a.componentTemplateName())
+	if err != nil {
+		return 0, err
+	}
+	version, _ := templateMetaVersion(installed)
+	return version, nil
+}
+
+// templateMetaVersion looks up the version in the "_meta" object of the
+// template, of the mappings or of the mappings of a type in templates of
+// Elasticsearch 6 and older. The "template" key holds the settings and
+// mappings of composable and component templates.
+func templateMetaVersion(t map[string]interface{}) (int, bool) {
+	if version, found := metaVersion(t["_meta"]); found {
+		return version, true
+	}
+	if nested, ok := t["template"].(map[string]interface{}); ok {
+		if version, found := templateMetaVersion(nested); found {
+			return version, true
+		}
+	}
+
+	mappings, ok := t["mappings"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	if version, found := metaVersion(mappings["_meta"]); found {
+		return version, true
+	}
+	for _, typed := range mappings {
+		if typed, ok := typed.(map[string]interface{}); ok {
+			if version, found := metaVersion(typed["_meta"]); found {
+				return version, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// metaVersion returns the template version of the "_meta" object, given as
+// number or as string
+func metaVersion(meta interface{}) (int, bool) {
+	object, ok := meta.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	switch v := object[templateVersionKey].(type) {
+	case float64:
+		return int(v), true
+	case string:
+		version, err := strconv.Atoi(v)
+		return version, err == nil
+	}
+	return 0, false
+}
+
+// templateBodyVersion returns the version of the given template body, e.g.
+// read from the template_file
+func templateBodyVersion(body string) (int, bool) {
+	var t map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &t); err != nil {
+		return 0, false
+	}
+	return templateMetaVersion(t)
+}
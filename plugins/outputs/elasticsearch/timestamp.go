@@ -0,0 +1,74 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+)
+
+// eventTime returns the time of the event held by the timestamp source field
+// of the metric. Numbers are parsed as epoch seconds and strings as RFC3339,
+// unless a format is configured. Layouts without a time zone are parsed in
+// the configured timezone. False is returned if the metric has no such field
+// or its value cannot be parsed, so the metric time is used instead.
+func (a *Elasticsearch) eventTime(metric telegraf.Metric) (time.Time, bool) {
+	if a.TimestampSourceField == "" {
+		return time.Time{}, false
+	}
+	value, ok := metric.GetField(a.TimestampSourceField)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	format := a.SourceTimeFormat
+	if format == "" {
+		format = "unix"
+		if _, ok := value.(string); ok {
+			format = time.RFC3339Nano
+		}
+	}
+	t, err := internal.ParseTimestamp(format, value, a.Timezone)
+	if err != nil {
+		a.Log.Debugf("Field '%s' of metric %q cannot be parsed as timestamp, using the metric time instead: %v", a.TimestampSourceField, metric.Name(), err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// timestampValue returns the "@timestamp" of the document in the configured
+// precision. Elasticsearch has no epoch format finer than milliseconds, so
+// microseconds and nanoseconds are sent as fractional milliseconds. They are
+// encoded as json.Number to keep all digits, which a float64 cannot hold.
+func (a *Elasticsearch) timestampValue(t time.Time) interface{} {
+	switch a.TimestampPrecision {
+	case "s":
+		return t.Unix()
+	case "ms":
+		return t.Unix()*1000 + int64(t.Nanosecond()/int(time.Millisecond))
+	case "us":
+		ms := t.Unix()*1000 + int64(t.Nanosecond()/int(time.Millisecond))
+		return json.Number(fmt.Sprintf("%d.%03d", ms, t.Nanosecond()%int(time.Millisecond)/int(time.Microsecond)))
+	case "ns":
+		ms := t.Unix()*1000 + int64(t.Nanosecond()/int(time.Millisecond))
+		return json.Number(fmt.Sprintf("%d.%06d", ms, t.Nanosecond()%int(time.Millisecond)))
+	}
+	return t
+}
+
+// timestampMapping returns the type and format of the "@timestamp" mapping
+// of the managed template matching the timestamp precision. Sub-millisecond
+// precisions need the "date_nanos" type, as "date" truncates to milliseconds.
+func (a *Elasticsearch) timestampMapping() (string, string) {
+	switch a.TimestampPrecision {
+	case "s":
+		return "date", "epoch_second"
+	case "ms":
+		return "date", "epoch_millis"
+	case "us", "ns":
+		return "date_nanos", "epoch_millis"
+	}
+	return "date", ""
+}
@@ -0,0 +1,46 @@
+package elasticsearch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// warmConnections establishes idle keep-alive connections to every node, so
+// the first write neither waits for resolving the node names nor for the TCP
+// and TLS handshakes. As many connections as bulk requests are sent
+// concurrently are opened per node, limited by max_idle_conns_per_host as
+// further connections would be closed right away. Failing nodes are only
+// logged, as the write fails over to other nodes anyway.
+func (a *Elasticsearch) warmConnections(ctx context.Context) {
+	perNode := a.MaxConcurrentBulks
+	if perNode > a.MaxIdleConnsPerHost {
+		perNode = a.MaxIdleConnsPerHost
+	}
+
+	start := time.Now()
+	nodes := a.nodes.all()
+	var mu sync.Mutex
+	var failed int
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		// Concurrent requests cannot share a connection, so each opens its own
+		for i := 0; i < perNode; i++ {
+			wg.Add(1)
+			go func(n *node) {
+				defer wg.Done()
+				if a.ping(ctx, n) == pingFailed {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}(n)
+		}
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		a.Log.Warnf("Warming %d of %d connections to %d nodes failed", failed, len(nodes)*perNode, len(nodes))
+	}
+	a.Log.Infof("Warmed connections to %d nodes in %s", len(nodes), time.Since(start).Round(time.Millisecond))
+}